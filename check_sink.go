@@ -0,0 +1,219 @@
+package main
+
+// Pluggable output sinks for http-check results
+// @author Robin Verlangen
+
+import (
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CheckSink receives every http-check result, in addition to the synchronous HTTP response
+type CheckSink interface {
+	Name() string
+	Emit(checkID string, result *ConsensusRequest, latency time.Duration, err error)
+}
+
+// CheckSinkRegistry resolves sink names configured on a check to their implementation
+type CheckSinkRegistry struct {
+	sinks map[string]CheckSink
+	mux   sync.RWMutex
+}
+
+// New sink registry
+func newCheckSinkRegistry() *CheckSinkRegistry {
+	return &CheckSinkRegistry{
+		sinks: make(map[string]CheckSink),
+	}
+}
+
+// Register adds a sink so checks can reference it by name
+func (r *CheckSinkRegistry) Register(sink CheckSink) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.sinks[sink.Name()] = sink
+}
+
+// Get looks up a registered sink by name
+func (r *CheckSinkRegistry) Get(name string) CheckSink {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return r.sinks[name]
+}
+
+// EmitAll fans a check result out to the given sink names, skipping unknown ones
+func (r *CheckSinkRegistry) EmitAll(names []string, checkID string, result *ConsensusRequest, latency time.Duration, err error) {
+	for _, name := range names {
+		sink := r.Get(name)
+		if sink == nil {
+			log.Println(fmt.Sprintf("WARN: Unknown check sink %s", name))
+			continue
+		}
+		sink.Emit(checkID, result, latency, err)
+	}
+}
+
+// histogramBucketsSeconds are the fixed upper bounds ("le") of the latency histogram on /metrics
+var histogramBucketsSeconds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// checkStats is the running tally kept per check by the Prometheus sink
+type checkStats struct {
+	successCount int64
+	errorCount   int64
+	lastSuccess  time.Time
+	bucketCounts []int64
+	latencySum   float64
+	latencyCount int64
+	mux          sync.Mutex
+}
+
+// PrometheusSink exposes per-check counters, a latency histogram and last-success gauges on /metrics
+type PrometheusSink struct {
+	stats map[string]*checkStats
+	mux   sync.RWMutex
+}
+
+// metricsRouteOnce guards the /metrics registration: newPrometheusSink runs once per process in
+// production, but httprouter panics if the same path is registered twice, which happens whenever
+// a second HttpCheckStore is constructed in the same process (e.g. across tests)
+var metricsRouteOnce sync.Once
+
+// New Prometheus sink, registers /metrics on router alongside every other handler in the app
+func newPrometheusSink(router *httprouter.Router) *PrometheusSink {
+	s := &PrometheusSink{stats: make(map[string]*checkStats)}
+	metricsRouteOnce.Do(func() {
+		router.GET("/metrics", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			s.handleMetrics(w, r)
+		})
+	})
+	return s
+}
+
+func (s *PrometheusSink) Name() string {
+	return "prometheus"
+}
+
+func (s *PrometheusSink) statsFor(checkID string) *checkStats {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	st, ok := s.stats[checkID]
+	if !ok {
+		st = &checkStats{bucketCounts: make([]int64, len(histogramBucketsSeconds))}
+		s.stats[checkID] = st
+	}
+	return st
+}
+
+func (s *PrometheusSink) Emit(checkID string, result *ConsensusRequest, latency time.Duration, err error) {
+	st := s.statsFor(checkID)
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	if err == nil {
+		st.successCount++
+		st.lastSuccess = time.Now()
+	} else {
+		st.errorCount++
+	}
+
+	seconds := latency.Seconds()
+	for i, le := range histogramBucketsSeconds {
+		if seconds <= le {
+			st.bucketCounts[i]++
+		}
+	}
+	st.latencySum += seconds
+	st.latencyCount++
+}
+
+// handleMetrics renders a cumulative Prometheus histogram for each check's latency, alongside the
+// plain success/error counters and the last-success gauge
+func (s *PrometheusSink) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	for checkID, st := range s.stats {
+		st.mux.Lock()
+		fmt.Fprintf(w, "dispenso_check_success_total{check=\"%s\"} %d\n", checkID, st.successCount)
+		fmt.Fprintf(w, "dispenso_check_error_total{check=\"%s\"} %d\n", checkID, st.errorCount)
+		fmt.Fprintf(w, "dispenso_check_last_success_timestamp{check=\"%s\"} %d\n", checkID, st.lastSuccess.Unix())
+		for i, le := range histogramBucketsSeconds {
+			fmt.Fprintf(w, "dispenso_check_latency_seconds_bucket{check=\"%s\",le=\"%g\"} %d\n", checkID, le, st.bucketCounts[i])
+		}
+		fmt.Fprintf(w, "dispenso_check_latency_seconds_bucket{check=\"%s\",le=\"+Inf\"} %d\n", checkID, st.latencyCount)
+		fmt.Fprintf(w, "dispenso_check_latency_seconds_sum{check=\"%s\"} %f\n", checkID, st.latencySum)
+		fmt.Fprintf(w, "dispenso_check_latency_seconds_count{check=\"%s\"} %d\n", checkID, st.latencyCount)
+		st.mux.Unlock()
+	}
+}
+
+// StatsdSink writes StatsD line protocol timing/counter metrics over UDP
+type StatsdSink struct {
+	conn   net.Conn
+	prefix string
+}
+
+// New StatsD sink, dials the given UDP address once and reuses the connection
+func newStatsdSink(addr string, prefix string) (*StatsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsdSink{conn: conn, prefix: prefix}, nil
+}
+
+func (s *StatsdSink) Name() string {
+	return "statsd"
+}
+
+func (s *StatsdSink) Emit(checkID string, result *ConsensusRequest, latency time.Duration, err error) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	line := fmt.Sprintf("%s.check.%s.%s:1|c\n%s.check.%s.latency_ms:%d|ms\n",
+		s.prefix, checkID, status, s.prefix, checkID, latency.Milliseconds())
+	if _, werr := s.conn.Write([]byte(line)); werr != nil {
+		log.Println(fmt.Sprintf("ERR: Failed to write statsd metric: %s", werr))
+	}
+}
+
+// WebhookSink POSTs a JSON payload describing the check result to a configured URL
+type WebhookSink struct {
+	URL    string
+	client *http.Client
+}
+
+// New webhook sink
+func newWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{
+		URL:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *WebhookSink) Emit(checkID string, result *ConsensusRequest, latency time.Duration, err error) {
+	jr := jresp.NewJsonResp()
+	jr.Set("check_id", checkID)
+	jr.Set("latency_ms", latency.Milliseconds())
+	if err != nil {
+		jr.Error(err.Error())
+	} else {
+		jr.OK()
+	}
+	resp, perr := s.client.Post(s.URL, "application/json", strings.NewReader(jr.ToString(false)))
+	if perr != nil {
+		log.Println(fmt.Sprintf("ERR: Failed to post webhook sink for check %s: %s", checkID, perr))
+		return
+	}
+	resp.Body.Close()
+}
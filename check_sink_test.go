@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusSinkEmitFoldsLatenciesIntoBuckets(t *testing.T) {
+	s := &PrometheusSink{stats: make(map[string]*checkStats)}
+
+	s.Emit("check-1", nil, 1*time.Millisecond, nil)
+	s.Emit("check-1", nil, 60*time.Millisecond, nil)
+	s.Emit("check-1", nil, 2*time.Second, errors.New("failure"))
+
+	st := s.statsFor("check-1")
+	if st.successCount != 2 {
+		t.Errorf("expected 2 successes, got %d", st.successCount)
+	}
+	if st.errorCount != 1 {
+		t.Errorf("expected 1 error, got %d", st.errorCount)
+	}
+	if st.latencyCount != 3 {
+		t.Errorf("expected 3 observations folded, got %d", st.latencyCount)
+	}
+
+	// Buckets are cumulative: the 1ms sample counts in every bucket, the 60ms sample from 0.1s up,
+	// and the 2s sample from 2.5s up; all three are <= the final bucket (le=10)
+	if st.bucketCounts[0] != 1 {
+		t.Errorf("expected bucket le=%g to have 1 observation, got %d", histogramBucketsSeconds[0], st.bucketCounts[0])
+	}
+	lastBucket := len(histogramBucketsSeconds) - 1
+	if st.bucketCounts[lastBucket] != 3 {
+		t.Errorf("expected bucket le=%g to have 3 observations, got %d", histogramBucketsSeconds[lastBucket], st.bucketCounts[lastBucket])
+	}
+}
+
+func TestPrometheusSinkStatsForAllocatesBucketsBeforeEmit(t *testing.T) {
+	s := &PrometheusSink{stats: make(map[string]*checkStats)}
+
+	// A /metrics scrape can observe a check right after statsFor creates it but before Emit runs;
+	// handleMetrics indexes bucketCounts unconditionally, so it must never be nil
+	st := s.statsFor("check-1")
+	if st.bucketCounts == nil {
+		t.Fatal("expected bucketCounts to be allocated by statsFor, got nil")
+	}
+	if len(st.bucketCounts) != len(histogramBucketsSeconds) {
+		t.Errorf("expected %d buckets, got %d", len(histogramBucketsSeconds), len(st.bucketCounts))
+	}
+}
+
+func TestPrometheusSinkHandleMetricsEmitsValidHistogramLines(t *testing.T) {
+	s := &PrometheusSink{stats: make(map[string]*checkStats)}
+	s.Emit("check-1", nil, 10*time.Millisecond, nil)
+
+	rec := httptest.NewRecorder()
+	s.handleMetrics(rec, nil)
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`dispenso_check_latency_seconds_bucket{check="check-1",le="+Inf"} 1`,
+		`dispenso_check_latency_seconds_sum{check="check-1"}`,
+		`dispenso_check_latency_seconds_count{check="check-1"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected /metrics output to contain %q, got:\n%s", want, body)
+		}
+	}
+}
@@ -1,15 +1,18 @@
 // @author Robin Verlangen
-// Discovery service used to detect cluster
+// Discovery service used to detect cluster membership with a SWIM-style gossip failure detector
 
 package main
 
 // Imports
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"strconv"
@@ -20,7 +23,63 @@ import (
 
 // Discovery constants
 const PING_TIMEOUT = 30 * time.Second
-const PING_INTERVAL = 1 * time.Second
+const PROTOCOL_PERIOD = 1 * time.Second // How often a node probes a random peer
+const INDIRECT_PING_TIMEOUT = 2 * time.Second
+const INDIRECT_PING_NODES = 3                  // Number of peers asked to indirect-ping a suspicious node
+const SUSPICION_BASE_TIMEOUT = 5 * time.Second // Scaled by log(N) members
+const GOSSIP_PORT_OFFSET = 1                   // Gossip ping/ack listens one port above the HTTP(S) API so it doesn't collide with it
+
+// MemberState is the failure detector state of a node as seen by the local node
+type MemberState int
+
+const (
+	Alive MemberState = iota
+	Suspect
+	Dead
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// MemberEventType describes the reason a MemberEvent was emitted
+type MemberEventType int
+
+const (
+	MemberJoined MemberEventType = iota
+	MemberLeft
+	MemberFailed
+)
+
+// MemberEvent is published on the DiscoveryService event channel whenever membership changes
+type MemberEvent struct {
+	Type MemberEventType
+	Node *Node
+}
+
+// membershipDelta is a compact, piggybackable description of a single membership change
+type membershipDelta struct {
+	Host        string      `json:"host"`
+	Port        int         `json:"port"`
+	Incarnation int         `json:"incarnation"`
+	State       MemberState `json:"state"`
+}
+
+// gossipEnvelope is what travels over the wire on every ping/ack
+type gossipEnvelope struct {
+	From   string            `json:"from"`
+	Kind   string            `json:"kind"` // ping, ack, indirect-ping, indirect-ack, indirect-nack
+	Target string            `json:"target,omitempty"`
+	Deltas []membershipDelta `json:"deltas,omitempty"`
+}
 
 // Node (entity in the Dispenso cluster)
 type Node struct {
@@ -28,8 +87,12 @@ type Node struct {
 	Host             string            // Fully qualified hostname
 	Port             int               // Port on which Dispenso runs
 
-	metaReceived bool         // Did we receive metadata?
-	mux          sync.RWMutex // Locking mechanism
+	Incarnation int         // Incarnation number, bumped whenever this node refutes a suspicion about itself
+	State       MemberState // Failure detector state as seen by the local node
+
+	metaReceived   bool         // Did we receive metadata?
+	stateChangedAt time.Time    // When State last transitioned
+	mux            sync.RWMutex // Locking mechanism
 }
 
 // Full name
@@ -37,14 +100,43 @@ func (n *Node) FullName() string {
 	return fmt.Sprintf("%s:%d", n.Host, n.Port)
 }
 
+// Gossip listener address
+func (n *Node) GossipAddr() string {
+	return fmt.Sprintf("%s:%d", n.Host, n.Port+GOSSIP_PORT_OFFSET)
+}
+
 // Full url
 func (n *Node) FullUrl(service string) string {
-	return fmt.Sprintf("http://%s/%s", n.FullName(), service)
+	return fmt.Sprintf("https://%s/%s", n.FullName(), service)
+}
+
+// setState transitions the node to a new failure detector state at the given incarnation, ignoring
+// stale (lower) incarnations; it never bumps the incarnation itself
+func (n *Node) setState(state MemberState, incarnation int) bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if state == n.State && incarnation <= n.Incarnation {
+		return false
+	}
+	if incarnation < n.Incarnation {
+		// Stale information, ignore
+		return false
+	}
+	n.State = state
+	n.Incarnation = incarnation
+	n.stateChangedAt = time.Now()
+	return true
+}
+
+func (n *Node) delta() membershipDelta {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return membershipDelta{Host: n.Host, Port: n.Port, Incarnation: n.Incarnation, State: n.State}
 }
 
 // Fetch node metadata
 func (n *Node) FetchMeta() bool {
-	resp, err := http.Get(n.FullUrl("discovery"))
+	resp, err := server.secureTransport.Client().Get(n.FullUrl("discovery"))
 	if err != nil {
 		log.Println(fmt.Sprintf("ERR: Failed to fetch node metadata %s"), err)
 		return false
@@ -80,16 +172,16 @@ func (n *Node) FetchMeta() bool {
 
 // Exchange node metadata
 func (n *Node) ExchangeMeta() bool {
-	// Client
-	httpclient := &http.Client{}
+	// Client, authenticated via the cluster's mutual TLS transport
+	httpclient := server.secureTransport.Client()
 
 	log.Println("INFO: Exchanging metadata")
 
 	// Metadata
 	var data map[string]string = make(map[string]string)
-	var nodeStrs []string = make([]string, len(n.DiscoveryService.Nodes))
-	for _, node := range n.DiscoveryService.Nodes {
-		nodeStrs = append(nodeStrs, fmt.Sprintf("%s:%d", node.Host, node.Port))
+	var nodeStrs []string = make([]string, 0, len(n.DiscoveryService.Members()))
+	for _, node := range n.DiscoveryService.Members() {
+		nodeStrs = append(nodeStrs, node.FullName())
 	}
 	data["nodes"] = strings.Join(nodeStrs, ",")
 
@@ -128,28 +220,46 @@ func (n *Node) ExchangeMeta() bool {
 	return true
 }
 
-// Ping a node
-func (n *Node) Ping() bool {
-	// Knock on the door
-	conn, err := net.DialTimeout("tcp", n.FullName(), PING_TIMEOUT)
+// directPing probes a node once over mTLS and exchanges gossip deltas via a short-lived connection
+func (n *Node) directPing(timeout time.Duration) bool {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", n.GossipAddr(), server.secureTransport.TLSConfig())
 	if err != nil {
 		return false
 	}
-	conn.Close()
+	defer conn.Close()
 
-	// Try to fetch metadata
+	env := gossipEnvelope{From: n.DiscoveryService.self.FullName(), Kind: "ping", Deltas: n.DiscoveryService.pendingDeltas()}
+	b, _ := json.Marshal(env)
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(append(b, '\n')); err != nil {
+		return false
+	}
+
+	var ack gossipEnvelope
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&ack); err != nil {
+		return false
+	}
+	n.DiscoveryService.mergeDeltas(ack.Deltas)
+
+	// Try to fetch metadata the first time we see a node
 	n.mux.RLock()
-	if n.metaReceived == false {
+	needMeta := !n.metaReceived
+	n.mux.RUnlock()
+	if needMeta {
 		go func() {
 			n.FetchMeta()
 		}()
 	}
-	n.mux.RUnlock()
 
-	// OK
 	return true
 }
 
+// Ping a node, retained for backwards compatibility with older call sites
+func (n *Node) Ping() bool {
+	return n.directPing(PING_TIMEOUT)
+}
+
 // Message (payload transmitted between nodes containing instructions)
 type Message struct {
 	Type    MessageType // Type of message
@@ -173,14 +283,28 @@ const (
 	taskExecution                            // After being approved a task execution will be sent to the nodes
 )
 
-// Discovery service
+// Discovery service, maintains cluster membership using a SWIM-style gossip failure detector
 type DiscoveryService struct {
-	Nodes []*Node // List of nodes
+	Nodes []*Node // List of known peers (excludes self)
+
+	self   *Node            // This node, as seen by peers
+	events chan MemberEvent // Membership change notifications
+	done   chan bool        // Signals the protocol period loop to stop
+
+	mux sync.RWMutex // Locking mechanism
 }
 
 // Create discovery service
-func NewDiscoveryService() *DiscoveryService {
-	return &DiscoveryService{}
+func NewDiscoveryService(host string, port int) *DiscoveryService {
+	d := &DiscoveryService{
+		events: make(chan MemberEvent, 64),
+		done:   make(chan bool, 1),
+	}
+	if port == 0 {
+		port = defaultPort
+	}
+	d.self = &Node{DiscoveryService: d, Host: resolveHostname(host), Port: port, State: Alive}
+	return d
 }
 
 // Set seeds
@@ -209,37 +333,369 @@ func (d *DiscoveryService) SetSeeds(seeds []string) error {
 			DiscoveryService: d,
 			Host:             split[0],
 			Port:             port,
+			State:            Alive,
 		}
+		d.mux.Lock()
 		d.Nodes = append(d.Nodes, n)
+		d.mux.Unlock()
+		d.emit(MemberJoined, n)
+	}
+	return nil
+}
+
+// Join the cluster via a seed list and start the gossip protocol period
+func (d *DiscoveryService) Join(seeds []string) error {
+	if err := d.SetSeeds(seeds); err != nil {
+		return err
+	}
+	d.Start()
+	return nil
+}
+
+// Leave the cluster, gossiping departure to known peers, and stop the protocol period loop
+func (d *DiscoveryService) Leave() error {
+	d.self.mux.Lock()
+	d.self.State = Dead
+	d.self.Incarnation++
+	d.self.mux.Unlock()
+
+	d.emit(MemberLeft, d.self)
+	d.broadcastSelf()
+
+	select {
+	case d.done <- true:
+	default:
+	}
+	return nil
+}
+
+// broadcastSelf gossips this node's current delta to every known peer
+func (d *DiscoveryService) broadcastSelf() {
+	deltas := []membershipDelta{d.self.delta()}
+	for _, n := range d.Members() {
+		go func(n *Node) {
+			conn, err := tls.DialWithDialer(&net.Dialer{Timeout: PROTOCOL_PERIOD}, "tcp", n.GossipAddr(), server.secureTransport.TLSConfig())
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			env := gossipEnvelope{From: d.self.FullName(), Kind: "ping", Deltas: deltas}
+			b, _ := json.Marshal(env)
+			conn.SetDeadline(time.Now().Add(PROTOCOL_PERIOD))
+			conn.Write(append(b, '\n'))
+		}(n)
+	}
+}
+
+// Members returns a snapshot of the currently known peers
+func (d *DiscoveryService) Members() []*Node {
+	d.mux.RLock()
+	defer d.mux.RUnlock()
+	members := make([]*Node, len(d.Nodes))
+	copy(members, d.Nodes)
+	return members
+}
+
+// Events exposes join/leave/fail notifications for consumers such as httpCheckStore
+func (d *DiscoveryService) Events() <-chan MemberEvent {
+	return d.events
+}
+
+func (d *DiscoveryService) emit(t MemberEventType, n *Node) {
+	select {
+	case d.events <- MemberEvent{Type: t, Node: n}:
+	default:
+		log.Println("WARN: Discovery event channel full, dropping event")
+	}
+}
+
+// aliveMembers returns the subset of known peers currently believed to be alive
+func (d *DiscoveryService) aliveMembers() []*Node {
+	var alive []*Node
+	for _, n := range d.Members() {
+		n.mux.RLock()
+		state := n.State
+		n.mux.RUnlock()
+		if state != Dead {
+			alive = append(alive, n)
+		}
+	}
+	return alive
+}
+
+// pendingDeltas collects the membership deltas to piggyback on the next outgoing ping/ack
+func (d *DiscoveryService) pendingDeltas() []membershipDelta {
+	members := d.Members()
+	deltas := make([]membershipDelta, 0, len(members)+1)
+	deltas = append(deltas, d.self.delta())
+	for _, n := range members {
+		deltas = append(deltas, n.delta())
+	}
+	return deltas
+}
+
+// mergeDeltas applies remotely learned membership deltas, emitting events on state transitions
+func (d *DiscoveryService) mergeDeltas(deltas []membershipDelta) {
+	for _, delta := range deltas {
+		if delta.Host == d.self.Host && delta.Port == d.self.Port {
+			// Someone suspects us, refute by bumping our own incarnation
+			if delta.State != Alive {
+				d.self.mux.Lock()
+				d.self.Incarnation++
+				d.self.mux.Unlock()
+			}
+			continue
+		}
+		n := d.findOrAdd(delta.Host, delta.Port)
+		if n.setState(delta.State, delta.Incarnation) {
+			if delta.State == Dead {
+				d.emit(MemberFailed, n)
+			}
+		}
+	}
+}
+
+// findOrAdd returns the known Node for host:port, registering it as a new member if unseen
+func (d *DiscoveryService) findOrAdd(host string, port int) *Node {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	for _, n := range d.Nodes {
+		if n.Host == host && n.Port == port {
+			return n
+		}
+	}
+	n := &Node{DiscoveryService: d, Host: host, Port: port, State: Alive}
+	d.Nodes = append(d.Nodes, n)
+	go d.emit(MemberJoined, n)
+	return n
+}
+
+// suspicionTimeout scales the base suspicion window by log(N) members
+func (d *DiscoveryService) suspicionTimeout() time.Duration {
+	n := len(d.Members()) + 1
+	factor := math.Log(float64(n))
+	if factor < 1 {
+		factor = 1
+	}
+	return time.Duration(float64(SUSPICION_BASE_TIMEOUT) * factor)
+}
+
+// indirectPing asks INDIRECT_PING_NODES random peers to probe a suspicious node on our behalf
+func (d *DiscoveryService) indirectPing(target *Node) bool {
+	helpers := d.aliveMembers()
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+
+	count := 0
+	result := make(chan bool, INDIRECT_PING_NODES)
+	for _, helper := range helpers {
+		if helper == target {
+			continue
+		}
+		if count >= INDIRECT_PING_NODES {
+			break
+		}
+		count++
+		go func(h *Node) {
+			conn, err := tls.DialWithDialer(&net.Dialer{Timeout: INDIRECT_PING_TIMEOUT}, "tcp", h.GossipAddr(), server.secureTransport.TLSConfig())
+			if err != nil {
+				result <- false
+				return
+			}
+			defer conn.Close()
+			env := gossipEnvelope{From: d.self.FullName(), Kind: "indirect-ping", Target: target.GossipAddr(), Deltas: d.pendingDeltas()}
+			b, _ := json.Marshal(env)
+			conn.SetDeadline(time.Now().Add(INDIRECT_PING_TIMEOUT))
+			if _, err := conn.Write(append(b, '\n')); err != nil {
+				result <- false
+				return
+			}
+			var ack gossipEnvelope
+			dec := json.NewDecoder(conn)
+			if err := dec.Decode(&ack); err != nil {
+				result <- false
+				return
+			}
+			result <- ack.Kind == "indirect-ack"
+		}(helper)
+	}
+	if count == 0 {
+		return false
+	}
+
+	timeout := time.After(INDIRECT_PING_TIMEOUT)
+	for i := 0; i < count; i++ {
+		select {
+		case ok := <-result:
+			if ok {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+	return false
+}
+
+// probeRandomMember runs a single direct-ping/indirect-ping round against a random peer
+func (d *DiscoveryService) probeRandomMember() {
+	members := d.aliveMembers()
+	if len(members) == 0 {
+		return
+	}
+	target := members[rand.Intn(len(members))]
+
+	if target.directPing(PROTOCOL_PERIOD) {
+		target.mux.RLock()
+		incarnation := target.Incarnation
+		target.mux.RUnlock()
+		target.setState(Alive, incarnation)
+		return
+	}
+
+	if d.indirectPing(target) {
+		target.mux.RLock()
+		incarnation := target.Incarnation
+		target.mux.RUnlock()
+		target.setState(Alive, incarnation)
+		return
+	}
+
+	target.mux.RLock()
+	alreadySuspect := target.State == Suspect
+	suspectSince := target.stateChangedAt
+	incarnation := target.Incarnation
+	target.mux.RUnlock()
+
+	if !alreadySuspect {
+		target.setState(Suspect, incarnation)
+		log.Println(fmt.Sprintf("WARN: Marking %s suspect", target.FullName()))
+		return
+	}
+
+	if time.Since(suspectSince) > d.suspicionTimeout() {
+		if target.setState(Dead, incarnation) {
+			log.Println(fmt.Sprintf("WARN: Marking %s dead", target.FullName()))
+			d.emit(MemberFailed, target)
+		}
+	}
+}
+
+// sweepSuspects expires suspicions on its own schedule, independent of the random probe cadence
+func (d *DiscoveryService) sweepSuspects() {
+	for _, n := range d.Members() {
+		n.mux.RLock()
+		suspect := n.State == Suspect
+		suspectSince := n.stateChangedAt
+		incarnation := n.Incarnation
+		n.mux.RUnlock()
+
+		if !suspect || time.Since(suspectSince) <= d.suspicionTimeout() {
+			continue
+		}
+		if n.setState(Dead, incarnation) {
+			log.Println(fmt.Sprintf("WARN: Marking %s dead", n.FullName()))
+			d.emit(MemberFailed, n)
+		}
+	}
+}
+
+// Listen starts the gossip mTLS listener that answers direct and indirect pings from peers
+func (d *DiscoveryService) Listen() error {
+	ln, err := tls.Listen("tcp", fmt.Sprintf(":%d", d.self.Port+GOSSIP_PORT_OFFSET), server.secureTransport.TLSConfig())
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer ln.Close()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				select {
+				case <-d.done:
+					return
+				default:
+					log.Println(fmt.Sprintf("WARN: Gossip listener accept failed: %s", err))
+					continue
+				}
+			}
+			go d.handleGossipConn(conn)
+		}
+	}()
+	return nil
+}
+
+// handleGossipConn answers one ping with an ack, or one indirect-ping with an indirect-ack or indirect-nack
+func (d *DiscoveryService) handleGossipConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(PROTOCOL_PERIOD))
+
+	var env gossipEnvelope
+	if err := json.NewDecoder(conn).Decode(&env); err != nil {
+		return
+	}
+	d.mergeDeltas(env.Deltas)
+
+	var reply gossipEnvelope
+	switch env.Kind {
+	case "ping":
+		reply = gossipEnvelope{From: d.self.FullName(), Kind: "ack", Deltas: d.pendingDeltas()}
+	case "indirect-ping":
+		// directPing can take close to INDIRECT_PING_TIMEOUT; extend the deadline so the ack write isn't cut off
+		conn.SetDeadline(time.Now().Add(INDIRECT_PING_TIMEOUT + PROTOCOL_PERIOD))
+		kind := "indirect-nack"
+		if target := d.nodeByAddr(env.Target); target != nil && target.directPing(INDIRECT_PING_TIMEOUT) {
+			kind = "indirect-ack"
+		}
+		reply = gossipEnvelope{From: d.self.FullName(), Kind: kind, Deltas: d.pendingDeltas()}
+	default:
+		return
+	}
+
+	b, err := json.Marshal(reply)
+	if err != nil {
+		return
+	}
+	conn.Write(append(b, '\n'))
+}
+
+// nodeByAddr resolves a "host:port" gossip address to the known Node, if any
+func (d *DiscoveryService) nodeByAddr(addr string) *Node {
+	for _, n := range d.Members() {
+		if n.GossipAddr() == addr {
+			return n
+		}
 	}
 	return nil
 }
 
 // Run discovery service
 func (d *DiscoveryService) Start() bool {
+	if err := d.Listen(); err != nil {
+		log.Println(fmt.Sprintf("ERR: Failed to start gossip listener: %s", err))
+		return false
+	}
+
 	go func() {
-		log.Println("INFO: Starting discovery")
+		log.Println("INFO: Starting gossip discovery")
 
-		// Iterate nodes
-		ticker := time.NewTicker(PING_INTERVAL)
+		ticker := time.NewTicker(PROTOCOL_PERIOD)
+		sweepTicker := time.NewTicker(PROTOCOL_PERIOD)
 		for {
 			select {
 			case <-ticker.C:
-				// Discover nodes
-				for _, node := range d.Nodes {
-					if !node.Ping() {
-						log.Println(fmt.Sprintf("WARN: Failed to detect %s", node.FullName()))
-					}
-				}
+				d.probeRandomMember()
+			case <-sweepTicker.C:
+				d.sweepSuspects()
+			case <-d.done:
+				ticker.Stop()
+				sweepTicker.Stop()
+				return
 			case <-shutdown:
 				ticker.Stop()
+				sweepTicker.Stop()
 				return
 			}
 		}
-
-		// @todo Run every once in a while, and remove shutdown
-
-		//shutdown <- true
 	}()
 	return true
-}
\ No newline at end of file
+}
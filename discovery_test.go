@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSuspicionTimeoutScalesWithMembers(t *testing.T) {
+	d := NewDiscoveryService("node-a", 8000)
+
+	solo := d.suspicionTimeout()
+	if solo != SUSPICION_BASE_TIMEOUT {
+		t.Errorf("expected base timeout %s with no members, got %s", SUSPICION_BASE_TIMEOUT, solo)
+	}
+
+	for i := 0; i < 10; i++ {
+		d.Nodes = append(d.Nodes, &Node{DiscoveryService: d, Host: "peer", Port: 9000 + i, State: Alive})
+	}
+
+	grown := d.suspicionTimeout()
+	if grown <= solo {
+		t.Errorf("expected suspicion timeout to grow with membership size, got %s after %s", grown, solo)
+	}
+}
+
+func TestNewDiscoveryServiceDefaultsHostAndPort(t *testing.T) {
+	d := NewDiscoveryService("", 0)
+	if d.self.Host == "" {
+		t.Error("expected self.Host to fall back to the OS hostname, got empty string")
+	}
+	if d.self.Port != defaultPort {
+		t.Errorf("expected self.Port to fall back to defaultPort %d, got %d", defaultPort, d.self.Port)
+	}
+
+	named := NewDiscoveryService("node-a", 8000)
+	if named.self.Host != "node-a" || named.self.Port != 8000 {
+		t.Errorf("expected self to be node-a:8000, got %s:%d", named.self.Host, named.self.Port)
+	}
+}
+
+func TestMergeDeltasRefutesSuspicionAboutSelf(t *testing.T) {
+	d := NewDiscoveryService("node-a", 8000)
+	before := d.self.Incarnation
+
+	d.mergeDeltas([]membershipDelta{{Host: "node-a", Port: 8000, State: Suspect, Incarnation: before}})
+
+	if d.self.Incarnation <= before {
+		t.Errorf("expected self to bump incarnation on refute, stayed at %d", d.self.Incarnation)
+	}
+	if len(d.Nodes) != 0 {
+		t.Errorf("a delta about self should not be registered as a peer, got %d nodes", len(d.Nodes))
+	}
+}
+
+func TestMergeDeltasTracksPeerState(t *testing.T) {
+	d := NewDiscoveryService("node-a", 8000)
+
+	d.mergeDeltas([]membershipDelta{{Host: "node-b", Port: 9000, State: Suspect, Incarnation: 1}})
+
+	n := d.findOrAdd("node-b", 9000)
+	n.mux.RLock()
+	state := n.State
+	n.mux.RUnlock()
+	if state != Suspect {
+		t.Errorf("expected peer node-b to be marked Suspect, got %s", state)
+	}
+}
+
+func TestSetStateIgnoresStaleIncarnation(t *testing.T) {
+	n := &Node{Host: "node-b", Port: 9000, State: Alive, Incarnation: 5}
+	if n.setState(Dead, 3) {
+		t.Error("expected setState to reject a stale (lower) incarnation")
+	}
+	if n.State != Alive {
+		t.Errorf("state should not have changed, got %s", n.State)
+	}
+
+	if !n.setState(Dead, 6) {
+		t.Error("expected setState to accept a newer incarnation")
+	}
+	if n.State != Dead {
+		t.Errorf("expected state Dead, got %s", n.State)
+	}
+}
@@ -9,7 +9,9 @@ import (
 	"github.com/RobinUS2/golang-jresp"
 	"github.com/julienschmidt/httprouter"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -18,8 +20,8 @@ import (
 // Http checks
 type HttpCheckStore struct {
 	Checks     map[string]*HttpCheckConfiguration
-	ConfFile   string
 	SystemUser *User
+	Sinks      *CheckSinkRegistry
 	mux        sync.RWMutex
 }
 
@@ -31,6 +33,8 @@ type HttpCheckConfiguration struct {
 	SecureToken string
 	Timeout     int
 	ClientIds   []string
+	SinkNames   []string  // Names of the registered CheckSinks this check publishes results to
+	Schedule    *Schedule // Optional cron cadence on which this check runs itself
 }
 
 // Http handler for the server
@@ -47,41 +51,65 @@ func GetHttpCheck(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		return
 	}
 
-	// Validate token
+	// Validate either the bare token or, when present, an HMAC-signed request
 	token := r.URL.Query().Get("token")
-	if len(token) < 1 || token != c.SecureToken {
+	authorized := len(token) > 0 && token == c.SecureToken
+	if !authorized && len(r.URL.Query().Get("sig")) > 0 {
+		authorized = verifySignedRequest(c.SecureToken, r)
+	}
+	if !authorized {
 		jr.Error("Secure token invalid")
 		fmt.Fprint(w, jr.ToString(debug))
 		return
 	}
 
 	// Execute the config
+	start := time.Now()
+	bus := newCheckEventBus()
+	bus.Publish(CheckStreamEvent{Type: EventQueued})
+
 	cr := server.consensus.AddRequest(c.TemplateId, c.ClientIds, server.httpCheckStore.SystemUser, "")
 	if cr == nil {
 		jr.Error("Unable to start check")
 		fmt.Fprint(w, jr.ToString(debug))
 		return
 	}
+	bus.Publish(CheckStreamEvent{Type: EventApproved})
 
-	// Register callback
-	done := make(chan bool, 1)
-	cb := func(cr *ConsensusRequest) {
-		done <- true
-	}
-	cr.Callbacks = append(cr.Callbacks, cb)
+	// Subscribe before triggering execution so we never miss the terminal result frame. The bus is
+	// this request's own: a /stream request for the same check starts a separate run on a separate bus
+	events, cancel := bus.Subscribe()
+	defer cancel()
+
+	cr.Callbacks = append(cr.Callbacks, func(cr *ConsensusRequest) {
+		bus.Publish(CheckStreamEvent{Type: EventResult, Success: true})
+	})
 
 	// Trigger execution
 	cr.check()
 
-	// Wait for success (or failure..)
-	select {
-	case <-time.After(time.Duration(c.Timeout) * time.Second):
-		jr.Error("Timeout")
-		fmt.Fprint(w, jr.ToString(debug))
-		return
-	case <-done:
+	// Wait for the terminal result frame (or failure..)
+waitResult:
+	for {
+		select {
+		case <-time.After(time.Duration(c.Timeout) * time.Second):
+			server.httpCheckStore.Sinks.EmitAll(c.SinkNames, c.Id, cr, time.Since(start), fmt.Errorf("Timeout"))
+			jr.Error("Timeout")
+			fmt.Fprint(w, jr.ToString(debug))
+			return
+		case evt, open := <-events:
+			if !open {
+				break waitResult
+			}
+			if evt.Type == EventResult {
+				break waitResult
+			}
+		}
 	}
 
+	// Fan out to configured sinks before the request is torn down
+	server.httpCheckStore.Sinks.EmitAll(c.SinkNames, c.Id, cr, time.Since(start), nil)
+
 	// Cleanup
 	cr.Delete()
 
@@ -104,23 +132,6 @@ func (s *HttpCheckStore) Add(e *HttpCheckConfiguration) {
 	s.Checks[e.Id] = e
 }
 
-// Save to disk
-func (s *HttpCheckStore) save() bool {
-	s.mux.Lock()
-	defer s.mux.Unlock()
-	bytes, je := json.Marshal(s.Checks)
-	if je != nil {
-		log.Printf("Failed to write http checks: %s", je)
-		return false
-	}
-	err := ioutil.WriteFile(s.ConfFile, bytes, 0644)
-	if err != nil {
-		log.Printf("Failed to write http checks: %s", err)
-		return false
-	}
-	return true
-}
-
 // List HTTP Checks
 func GetHttpChecks(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	jr := jresp.NewJsonResp()
@@ -180,37 +191,71 @@ func PostHttpCheck(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	// Client IDs
 	clientIds := strings.Split(strings.TrimSpace(r.PostFormValue("clients")), ",")
 
+	// Sinks (optional), comma separated names of already-registered CheckSinks to fan results out to
+	var sinkNames []string
+	if raw := strings.TrimSpace(r.PostFormValue("sinks")); len(raw) > 0 {
+		for _, name := range strings.Split(raw, ",") {
+			name = strings.TrimSpace(name)
+			if server.httpCheckStore.Sinks.Get(name) == nil {
+				jr.Error(fmt.Sprintf("Unknown check sink %s", name))
+				fmt.Fprint(w, jr.ToString(debug))
+				return
+			}
+			sinkNames = append(sinkNames, name)
+		}
+	}
+
+	// Schedule (optional): a cron cadence the check runs itself on, independent of external pollers
+	sched, serr := parseScheduleForm(r)
+	if serr != nil {
+		jr.Error(serr.Error())
+		fmt.Fprint(w, jr.ToString(debug))
+		return
+	}
+
 	// Create
 	hc := newHttpCheckConfiguration()
 	hc.ClientIds = clientIds
 	hc.TemplateId = templateId
 	hc.Enabled = true
 	hc.Timeout = 30
+	hc.SinkNames = sinkNames
+	hc.Schedule = sched
 
-	// Add and save
-	server.httpCheckStore.Add(hc)
-	server.httpCheckStore.save()
+	// Propose to the cluster; the ReplicatedStore forwards to the Raft leader when needed
+	if err := server.replicatedStore.AddCheck(hc, r); err != nil {
+		jr.Error(fmt.Sprintf("Failed to replicate check: %s", err))
+		fmt.Fprint(w, jr.ToString(debug))
+		return
+	}
 
 	// Done
 	jr.OK()
 	fmt.Fprint(w, jr.ToString(debug))
 }
 
-// Load from disk
-func (s *HttpCheckStore) load() {
-	s.mux.Lock()
-	defer s.mux.Unlock()
-	// Read file and load into user store
-	bytes, err := ioutil.ReadFile(s.ConfFile)
-	if err == nil {
-		var v map[string]*HttpCheckConfiguration
-		je := json.Unmarshal(bytes, &v)
-		if je != nil {
-			log.Printf("Invalid httpchecks.json: %s", je)
-			return
+// legacyHttpChecksFile is the pre-Raft on-disk check store; migrateLegacyHttpChecks is the only
+// code that still touches it
+const legacyHttpChecksFile = "/etc/indispenso/httpchecks.json"
+
+// migrateLegacyHttpChecks proposes any checks found in the pre-Raft httpchecks.json through the
+// ReplicatedStore, then renames the file so it isn't proposed again on the next boot. Call once,
+// after the ReplicatedStore is up; a missing file is not an error
+func migrateLegacyHttpChecks(rs *ReplicatedStore) error {
+	bytes, err := ioutil.ReadFile(legacyHttpChecksFile)
+	if err != nil {
+		return nil
+	}
+	var checks map[string]*HttpCheckConfiguration
+	if err := json.Unmarshal(bytes, &checks); err != nil {
+		return fmt.Errorf("Invalid %s: %s", legacyHttpChecksFile, err)
+	}
+	for _, hc := range checks {
+		if err := rs.AddCheck(hc, nil); err != nil {
+			return fmt.Errorf("Failed to migrate check %s: %s", hc.Id, err)
 		}
-		s.Checks = v
 	}
+	return os.Rename(legacyHttpChecksFile, legacyHttpChecksFile+".migrated")
 }
 
 // New store
@@ -218,14 +263,34 @@ func newHttpCheckStore() *HttpCheckStore {
 	systemUser := newUser()
 	systemUser.AddRole("requester")
 	s := &HttpCheckStore{
-		ConfFile:   "/etc/indispenso/httpchecks.json",
 		Checks:     make(map[string]*HttpCheckConfiguration),
 		SystemUser: systemUser,
+		Sinks:      newCheckSinkRegistry(),
 	}
-	s.load()
+	s.registerSinks()
 	return s
 }
 
+// registerSinks wires up the CheckSink implementations a check can reference by name in
+// SinkNames; the Prometheus sink is always on (it just exposes /metrics), the others only attach
+// when their destination is configured through the environment
+func (s *HttpCheckStore) registerSinks() {
+	s.Sinks.Register(newPrometheusSink(server.router))
+
+	if addr := strings.TrimSpace(os.Getenv("DISPENSO_STATSD_ADDR")); len(addr) > 0 {
+		sink, err := newStatsdSink(addr, "dispenso")
+		if err != nil {
+			log.Printf("Failed to start statsd check sink: %s", err)
+		} else {
+			s.Sinks.Register(sink)
+		}
+	}
+
+	if url := strings.TrimSpace(os.Getenv("DISPENSO_WEBHOOK_URL")); len(url) > 0 {
+		s.Sinks.Register(newWebhookSink(url))
+	}
+}
+
 // New check
 func newHttpCheckConfiguration() *HttpCheckConfiguration {
 	token, _ := secureRandomString(32)
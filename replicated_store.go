@@ -0,0 +1,436 @@
+package main
+
+// Replicated, Raft-backed store for cluster config: http checks, templates and users
+// @author Robin Verlangen
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fsmOp is the type of mutation carried by a single Raft log entry
+type fsmOp string
+
+const (
+	opAddCheck          fsmOp = "add_check"
+	opDeleteCheck       fsmOp = "delete_check"
+	opEnableCheck       fsmOp = "enable_check"
+	opSetSchedulePaused fsmOp = "set_schedule_paused"
+	opUpdateTemplate    fsmOp = "update_template"
+	opDeleteTemplate    fsmOp = "delete_template"
+	opUpdateUser        fsmOp = "update_user"
+	opDeleteUser        fsmOp = "delete_user"
+)
+
+// fsmCommand is the typed log entry applied to the replicated FSM
+type fsmCommand struct {
+	Op      fsmOp           `json:"op"`
+	Id      string          `json:"id"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Enabled bool            `json:"enabled,omitempty"`
+}
+
+// clusterFSM holds the replicated Checks, Templates and Users maps mutated only through Raft Apply
+type clusterFSM struct {
+	checkStore    *HttpCheckStore
+	templateStore *TemplateStore
+	userStore     *UserStore
+	scheduler     *Scheduler // Rescheduled on every node when a check's cadence or pause state changes
+	mux           sync.Mutex
+}
+
+func (f *clusterFSM) Apply(entry *raft.Log) interface{} {
+	var cmd fsmCommand
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		log.Println(fmt.Sprintf("ERR: Invalid FSM log entry: %s", err))
+		return err
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	switch cmd.Op {
+	case opAddCheck:
+		var hc HttpCheckConfiguration
+		if err := json.Unmarshal(cmd.Payload, &hc); err != nil {
+			return err
+		}
+		f.checkStore.Add(&hc)
+		if f.scheduler != nil {
+			f.scheduler.Reschedule(&hc)
+		}
+	case opDeleteCheck:
+		f.checkStore.mux.Lock()
+		delete(f.checkStore.Checks, cmd.Id)
+		f.checkStore.mux.Unlock()
+	case opEnableCheck:
+		f.checkStore.mux.Lock()
+		if hc, ok := f.checkStore.Checks[cmd.Id]; ok {
+			hc.Enabled = cmd.Enabled
+		}
+		f.checkStore.mux.Unlock()
+	case opSetSchedulePaused:
+		f.checkStore.mux.Lock()
+		hc, ok := f.checkStore.Checks[cmd.Id]
+		if ok && hc.Schedule != nil {
+			hc.Schedule.Paused = cmd.Enabled
+		}
+		f.checkStore.mux.Unlock()
+		if ok && f.scheduler != nil {
+			f.scheduler.Reschedule(hc)
+		}
+	case opUpdateTemplate:
+		var t Template
+		if err := json.Unmarshal(cmd.Payload, &t); err != nil {
+			return err
+		}
+		f.templateStore.Add(&t)
+	case opDeleteTemplate:
+		f.templateStore.mux.Lock()
+		delete(f.templateStore.Templates, cmd.Id)
+		f.templateStore.mux.Unlock()
+	case opUpdateUser:
+		var u User
+		if err := json.Unmarshal(cmd.Payload, &u); err != nil {
+			return err
+		}
+		f.userStore.Add(&u)
+	case opDeleteUser:
+		f.userStore.mux.Lock()
+		delete(f.userStore.Users, cmd.Id)
+		f.userStore.mux.Unlock()
+	default:
+		log.Println(fmt.Sprintf("WARN: Unknown FSM op %s", cmd.Op))
+	}
+	return nil
+}
+
+// clusterSnapshot is the serialized state captured by Snapshot() and written out by Persist()
+type clusterSnapshot struct {
+	Checks    map[string]*HttpCheckConfiguration `json:"checks"`
+	Templates map[string]*Template               `json:"templates"`
+	Users     map[string]*User                   `json:"users"`
+}
+
+func (f *clusterFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.checkStore.mux.RLock()
+	f.templateStore.mux.RLock()
+	f.userStore.mux.RLock()
+	defer f.checkStore.mux.RUnlock()
+	defer f.templateStore.mux.RUnlock()
+	defer f.userStore.mux.RUnlock()
+
+	snap := &clusterSnapshot{
+		Checks:    make(map[string]*HttpCheckConfiguration, len(f.checkStore.Checks)),
+		Templates: make(map[string]*Template, len(f.templateStore.Templates)),
+		Users:     make(map[string]*User, len(f.userStore.Users)),
+	}
+	for k, v := range f.checkStore.Checks {
+		snap.Checks[k] = v
+	}
+	for k, v := range f.templateStore.Templates {
+		snap.Templates[k] = v
+	}
+	for k, v := range f.userStore.Users {
+		snap.Users[k] = v
+	}
+	return &fsmSnapshot{snapshot: snap}, nil
+}
+
+func (f *clusterFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var snap clusterSnapshot
+	if err := json.NewDecoder(rc).Decode(&snap); err != nil {
+		return err
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.checkStore.mux.Lock()
+	f.checkStore.Checks = snap.Checks
+	f.checkStore.mux.Unlock()
+
+	f.templateStore.mux.Lock()
+	f.templateStore.Templates = snap.Templates
+	f.templateStore.mux.Unlock()
+
+	f.userStore.mux.Lock()
+	f.userStore.Users = snap.Users
+	f.userStore.mux.Unlock()
+
+	return nil
+}
+
+// fsmSnapshot adapts a clusterSnapshot to raft.FSMSnapshot
+type fsmSnapshot struct {
+	snapshot *clusterSnapshot
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	b, err := json.Marshal(s.snapshot)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	if _, err := sink.Write(b); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
+
+// ReplicatedStore wraps a Raft group that replicates http checks, templates and users across the cluster
+type ReplicatedStore struct {
+	raft *raft.Raft
+	fsm  *clusterFSM
+	bind string
+}
+
+// newReplicatedStore brings up Raft against dataDir
+func newReplicatedStore(dataDir string, bindAddr string, checkStore *HttpCheckStore, templateStore *TemplateStore, userStore *UserStore, scheduler *Scheduler) (*ReplicatedStore, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+
+	fsm := &clusterFSM{checkStore: checkStore, templateStore: templateStore, userStore: userStore, scheduler: scheduler}
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(bindAddr)
+
+	addr, err := net.ResolveTCPAddr("tcp", bindAddr)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(bindAddr, addr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := raft.NewFileSnapshotStore(dataDir, 2, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	logStore, err := raftboltdb.NewBoltStore(filepath.Join(dataDir, "raft-log.bolt"))
+	if err != nil {
+		return nil, err
+	}
+	stableStore, err := raftboltdb.NewBoltStore(filepath.Join(dataDir, "raft-stable.bolt"))
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := raft.NewRaft(conf, fsm, logStore, stableStore, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &ReplicatedStore{raft: r, fsm: fsm, bind: bindAddr}
+	return rs, nil
+}
+
+// bootstrapFromSeeds forms the initial Raft configuration from the DiscoveryService seed list
+func (rs *ReplicatedStore) bootstrapFromSeeds(d *DiscoveryService) error {
+	servers := []raft.Server{{ID: raft.ServerID(rs.bind), Address: raft.ServerAddress(rs.bind)}}
+	for _, n := range d.Members() {
+		servers = append(servers, raft.Server{ID: raft.ServerID(n.FullName()), Address: raft.ServerAddress(n.FullName())})
+	}
+	f := rs.raft.BootstrapCluster(raft.Configuration{Servers: servers})
+	return f.Error()
+}
+
+// IsLeader reports whether this node currently holds Raft leadership
+func (rs *ReplicatedStore) IsLeader() bool {
+	return rs.raft.State() == raft.Leader
+}
+
+// Leader returns the address of the current Raft leader, as known locally
+func (rs *ReplicatedStore) Leader() string {
+	return string(rs.raft.Leader())
+}
+
+// apply proposes a command, forwarding it to the leader when this node is a follower
+func (rs *ReplicatedStore) apply(cmd fsmCommand, r *http.Request) error {
+	if !rs.IsLeader() {
+		return rs.forwardToLeader(cmd, r)
+	}
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	f := rs.raft.Apply(b, 10*time.Second)
+	return f.Error()
+}
+
+// forwardToLeader POSTs a pending command to the admin endpoint of the current leader, carrying
+// forward the caller's auth
+func (rs *ReplicatedStore) forwardToLeader(cmd fsmCommand, r *http.Request) error {
+	leader := rs.Leader()
+	if len(leader) == 0 {
+		return fmt.Errorf("No known leader")
+	}
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/admin/raft/propose", leader), strings.NewReader(string(b)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r != nil {
+		req.Header.Set("Authorization", r.Header.Get("Authorization"))
+		if cookie := r.Header.Get("Cookie"); len(cookie) > 0 {
+			req.Header.Set("Cookie", cookie)
+		}
+	}
+	resp, err := server.secureTransport.Client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Leader rejected proposal: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// AddCheck proposes a new http check to the cluster
+func (rs *ReplicatedStore) AddCheck(hc *HttpCheckConfiguration, r *http.Request) error {
+	b, err := json.Marshal(hc)
+	if err != nil {
+		return err
+	}
+	return rs.apply(fsmCommand{Op: opAddCheck, Id: hc.Id, Payload: b}, r)
+}
+
+// DeleteCheck proposes removing a http check from the cluster
+func (rs *ReplicatedStore) DeleteCheck(id string, r *http.Request) error {
+	return rs.apply(fsmCommand{Op: opDeleteCheck, Id: id}, r)
+}
+
+// EnableCheck proposes toggling a http check on or off
+func (rs *ReplicatedStore) EnableCheck(id string, enabled bool, r *http.Request) error {
+	return rs.apply(fsmCommand{Op: opEnableCheck, Id: id, Enabled: enabled}, r)
+}
+
+// SetSchedulePaused proposes pausing or resuming a check's cron schedule
+func (rs *ReplicatedStore) SetSchedulePaused(id string, paused bool, r *http.Request) error {
+	return rs.apply(fsmCommand{Op: opSetSchedulePaused, Id: id, Enabled: paused}, r)
+}
+
+// UpdateTemplate proposes an upsert of a template
+func (rs *ReplicatedStore) UpdateTemplate(t *Template, r *http.Request) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return rs.apply(fsmCommand{Op: opUpdateTemplate, Id: t.Id, Payload: b}, r)
+}
+
+// DeleteTemplate proposes removing a template from the cluster
+func (rs *ReplicatedStore) DeleteTemplate(id string, r *http.Request) error {
+	return rs.apply(fsmCommand{Op: opDeleteTemplate, Id: id}, r)
+}
+
+// UpdateUser proposes an upsert of a user
+func (rs *ReplicatedStore) UpdateUser(u *User, r *http.Request) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return rs.apply(fsmCommand{Op: opUpdateUser, Id: u.Id, Payload: b}, r)
+}
+
+// DeleteUser proposes removing a user from the cluster
+func (rs *ReplicatedStore) DeleteUser(id string, r *http.Request) error {
+	return rs.apply(fsmCommand{Op: opDeleteUser, Id: id}, r)
+}
+
+// AdminRaftStatus is served from an admin endpoint so operators can see leader/follower status
+func AdminRaftStatus(w http.ResponseWriter, r *http.Request) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(debug))
+		return
+	}
+	user := getUser(r)
+	if !user.HasRole("admin") {
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(debug))
+		return
+	}
+
+	jr.Set("leader", server.replicatedStore.Leader())
+	jr.Set("is_leader", server.replicatedStore.IsLeader())
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(debug))
+}
+
+// AdminRaftPropose applies a command forwarded by a follower; it is peer-to-peer traffic, not a
+// user-facing admin action, so it requires a cluster peer's mTLS client cert, not just an admin
+// session, otherwise a stolen admin session could forge an op that bypasses the originating
+// handler's own validation (e.g. the TOTP check in PostHttpCheck)
+func AdminRaftPropose(w http.ResponseWriter, r *http.Request) {
+	jr := jresp.NewJsonResp()
+	// Rejections carry a non-200 status, which is what forwardToLeader checks for
+	if !isClusterPeer(r) {
+		w.WriteHeader(http.StatusForbidden)
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(debug))
+		return
+	}
+	if !authUser(r) {
+		w.WriteHeader(http.StatusForbidden)
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(debug))
+		return
+	}
+	user := getUser(r)
+	if !user.HasRole("admin") {
+		w.WriteHeader(http.StatusForbidden)
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(debug))
+		return
+	}
+
+	if !server.replicatedStore.IsLeader() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		jr.Error("Not leader")
+		fmt.Fprint(w, jr.ToString(debug))
+		return
+	}
+	var cmd fsmCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		jr.Error("Invalid command")
+		fmt.Fprint(w, jr.ToString(debug))
+		return
+	}
+	b, _ := json.Marshal(cmd)
+	f := server.replicatedStore.raft.Apply(b, 10*time.Second)
+	if err := f.Error(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		jr.Error(err.Error())
+		fmt.Fprint(w, jr.ToString(debug))
+		return
+	}
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(debug))
+}
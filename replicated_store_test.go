@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/hashicorp/raft"
+	"io/ioutil"
+	"testing"
+)
+
+func newTestFSM() *clusterFSM {
+	return &clusterFSM{
+		checkStore:    newHttpCheckStore(),
+		templateStore: &TemplateStore{Templates: make(map[string]*Template)},
+		userStore:     &UserStore{Users: make(map[string]*User)},
+	}
+}
+
+func applyOp(t *testing.T, f *clusterFSM, cmd fsmCommand) {
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatalf("failed to marshal command: %s", err)
+	}
+	if res := f.Apply(&raft.Log{Data: b}); res != nil {
+		t.Fatalf("expected Apply to succeed, got %v", res)
+	}
+}
+
+func TestClusterFSMApplyAddAndDeleteCheck(t *testing.T) {
+	f := newTestFSM()
+	hc := &HttpCheckConfiguration{Id: "check-1", Enabled: true}
+	payload, _ := json.Marshal(hc)
+
+	applyOp(t, f, fsmCommand{Op: opAddCheck, Id: hc.Id, Payload: payload})
+	if f.checkStore.Get("check-1") == nil {
+		t.Fatal("expected check-1 to be present after opAddCheck")
+	}
+
+	applyOp(t, f, fsmCommand{Op: opDeleteCheck, Id: hc.Id})
+	if f.checkStore.Get("check-1") != nil {
+		t.Error("expected check-1 to be gone after opDeleteCheck")
+	}
+}
+
+func TestClusterFSMApplyEnableCheck(t *testing.T) {
+	f := newTestFSM()
+	hc := &HttpCheckConfiguration{Id: "check-1", Enabled: true}
+	f.checkStore.Add(hc)
+
+	applyOp(t, f, fsmCommand{Op: opEnableCheck, Id: "check-1", Enabled: false})
+	if f.checkStore.Get("check-1").Enabled {
+		t.Error("expected opEnableCheck to disable the check")
+	}
+}
+
+func TestClusterFSMApplySetSchedulePausedReschedules(t *testing.T) {
+	f := newTestFSM()
+	hc := &HttpCheckConfiguration{Id: "check-1", Enabled: true, Schedule: &Schedule{Cron: "* * * * *"}}
+	f.checkStore.Add(hc)
+	f.scheduler = newScheduler(f.checkStore)
+	f.scheduler.Reschedule(hc)
+	if _, ok := f.scheduler.entries["check-1"]; !ok {
+		t.Fatal("expected check-1 to have a cron entry before it is paused")
+	}
+
+	applyOp(t, f, fsmCommand{Op: opSetSchedulePaused, Id: "check-1", Enabled: true})
+	if !f.checkStore.Get("check-1").Schedule.Paused {
+		t.Error("expected opSetSchedulePaused to pause the check's schedule")
+	}
+	if _, ok := f.scheduler.entries["check-1"]; ok {
+		t.Error("expected opSetSchedulePaused to reschedule the check, dropping its cron entry while paused")
+	}
+}
+
+func TestClusterFSMApplyUnknownOpReturnsNilWithoutPanic(t *testing.T) {
+	f := newTestFSM()
+	applyOp(t, f, fsmCommand{Op: "bogus"})
+}
+
+func TestClusterFSMSnapshotRestoreRoundTrip(t *testing.T) {
+	f := newTestFSM()
+	f.checkStore.Add(&HttpCheckConfiguration{Id: "check-1", Enabled: true})
+	f.templateStore.Add(&Template{Id: "tmpl-1"})
+	f.userStore.Add(&User{Id: "user-1"})
+
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := snap.Persist(&fakeSnapshotSink{Buffer: &buf}); err != nil {
+		t.Fatalf("Persist failed: %s", err)
+	}
+
+	restored := newTestFSM()
+	if err := restored.Restore(ioutil.NopCloser(&buf)); err != nil {
+		t.Fatalf("Restore failed: %s", err)
+	}
+
+	if restored.checkStore.Get("check-1") == nil {
+		t.Error("expected check-1 to survive the snapshot/restore round trip")
+	}
+	if _, ok := restored.templateStore.Templates["tmpl-1"]; !ok {
+		t.Error("expected tmpl-1 to survive the snapshot/restore round trip")
+	}
+	if _, ok := restored.userStore.Users["user-1"]; !ok {
+		t.Error("expected user-1 to survive the snapshot/restore round trip")
+	}
+}
+
+// fakeSnapshotSink is a minimal raft.SnapshotSink backed by an in-memory buffer
+type fakeSnapshotSink struct {
+	*bytes.Buffer
+}
+
+func (s *fakeSnapshotSink) ID() string    { return "test" }
+func (s *fakeSnapshotSink) Cancel() error { return nil }
+func (s *fakeSnapshotSink) Close() error  { return nil }
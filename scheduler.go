@@ -0,0 +1,310 @@
+package main
+
+// Cron-driven scheduling for http checks, independent of external pollers
+// @author Robin Verlangen
+
+import (
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	cron "github.com/robfig/cron/v3"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const scheduleHistorySize = 50 // Number of past results kept per check in the ring buffer
+
+// Schedule describes how a check should be run on its own cadence, independent of external pollers
+type Schedule struct {
+	Cron           string        // Standard 5-field cron expression
+	JitterMax      time.Duration // Upper bound of a random delay added before each run
+	MaxConcurrency int           // Maximum number of concurrent executions of this check
+	Paused         bool          // When true the scheduler skips this check's cadence
+}
+
+// ScheduledResult is one entry in a check's history ring buffer
+type ScheduledResult struct {
+	RunAt    time.Time
+	Latency  time.Duration
+	Success  bool
+	ErrorMsg string
+}
+
+// checkHistory is the fixed-size ring buffer of recent scheduled runs for a single check
+type checkHistory struct {
+	results []ScheduledResult
+	mux     sync.Mutex
+}
+
+func (h *checkHistory) record(res ScheduledResult) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.results = append(h.results, res)
+	if len(h.results) > scheduleHistorySize {
+		h.results = h.results[len(h.results)-scheduleHistorySize:]
+	}
+}
+
+func (h *checkHistory) snapshot() []ScheduledResult {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	out := make([]ScheduledResult, len(h.results))
+	copy(out, h.results)
+	return out
+}
+
+// Scheduler runs each enabled check's Schedule on a cron cadence, recording results in a ring buffer
+type Scheduler struct {
+	store    *HttpCheckStore
+	cron     *cron.Cron
+	entries  map[string]cron.EntryID
+	history  map[string]*checkHistory
+	inFlight map[string]int
+	mux      sync.Mutex
+}
+
+// newScheduler wires a Scheduler to its HttpCheckStore
+func newScheduler(store *HttpCheckStore) *Scheduler {
+	return &Scheduler{
+		store:    store,
+		cron:     cron.New(),
+		entries:  make(map[string]cron.EntryID),
+		history:  make(map[string]*checkHistory),
+		inFlight: make(map[string]int),
+	}
+}
+
+// parseScheduleForm builds a Schedule from optional POST fields ("cron", "jitter_max_seconds",
+// "max_concurrency"); returns (nil, nil) when the caller didn't supply a cron expression
+func parseScheduleForm(r *http.Request) (*Schedule, error) {
+	cronExpr := strings.TrimSpace(r.PostFormValue("cron"))
+	if len(cronExpr) == 0 {
+		return nil, nil
+	}
+	if _, err := cron.ParseStandard(cronExpr); err != nil {
+		return nil, fmt.Errorf("Invalid cron expression: %s", err)
+	}
+
+	sched := &Schedule{Cron: cronExpr, MaxConcurrency: 1}
+
+	if raw := strings.TrimSpace(r.PostFormValue("jitter_max_seconds")); len(raw) > 0 {
+		secs, err := strconv.Atoi(raw)
+		if err != nil || secs < 0 {
+			return nil, fmt.Errorf("Invalid jitter_max_seconds")
+		}
+		sched.JitterMax = time.Duration(secs) * time.Second
+	}
+
+	if raw := strings.TrimSpace(r.PostFormValue("max_concurrency")); len(raw) > 0 {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid max_concurrency")
+		}
+		sched.MaxConcurrency = n
+	}
+
+	return sched, nil
+}
+
+// Start schedules every enabled check that carries a Schedule and begins the cron dispatcher
+func (s *Scheduler) Start() {
+	s.store.mux.RLock()
+	for _, c := range s.store.Checks {
+		s.scheduleLocked(c)
+	}
+	s.store.mux.RUnlock()
+	s.cron.Start()
+}
+
+// Reschedule re-registers a single check, removing any previously registered cron entry first
+func (s *Scheduler) Reschedule(c *HttpCheckConfiguration) {
+	s.mux.Lock()
+	if id, ok := s.entries[c.Id]; ok {
+		s.cron.Remove(id)
+		delete(s.entries, c.Id)
+	}
+	s.mux.Unlock()
+	s.scheduleLocked(c)
+}
+
+func (s *Scheduler) scheduleLocked(c *HttpCheckConfiguration) {
+	if c.Schedule == nil || len(c.Schedule.Cron) == 0 || c.Schedule.Paused || !c.Enabled {
+		return
+	}
+	checkId := c.Id
+	id, err := s.cron.AddFunc(c.Schedule.Cron, func() {
+		s.runScheduled(checkId)
+	})
+	if err != nil {
+		log.Println(fmt.Sprintf("ERR: Invalid schedule for check %s: %s", checkId, err))
+		return
+	}
+	s.mux.Lock()
+	s.entries[checkId] = id
+	s.mux.Unlock()
+}
+
+// runScheduled fires a single scheduled run, skipping it when this node is not the Raft leader,
+// the schedule is paused, or the check is at its configured max-concurrency
+func (s *Scheduler) runScheduled(checkId string) {
+	if server.replicatedStore != nil && !server.replicatedStore.IsLeader() {
+		return
+	}
+
+	c := s.store.Get(checkId)
+	if c == nil || !c.Enabled || c.Schedule == nil || c.Schedule.Paused {
+		return
+	}
+
+	s.mux.Lock()
+	if s.inFlight[checkId] >= maxInt(c.Schedule.MaxConcurrency, 1) {
+		s.mux.Unlock()
+		return
+	}
+	s.inFlight[checkId]++
+	s.mux.Unlock()
+
+	defer func() {
+		s.mux.Lock()
+		s.inFlight[checkId]--
+		s.mux.Unlock()
+	}()
+
+	if c.Schedule.JitterMax > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(c.Schedule.JitterMax))))
+	}
+
+	start := time.Now()
+	cr := server.consensus.AddRequest(c.TemplateId, c.ClientIds, s.store.SystemUser, "")
+	if cr == nil {
+		s.record(checkId, start, fmt.Errorf("Unable to start check"))
+		return
+	}
+
+	done := make(chan bool, 1)
+	cr.Callbacks = append(cr.Callbacks, func(cr *ConsensusRequest) {
+		done <- true
+	})
+	cr.check()
+
+	var runErr error
+	select {
+	case <-time.After(time.Duration(c.Timeout) * time.Second):
+		runErr = fmt.Errorf("Timeout")
+	case <-done:
+	}
+	s.record(checkId, start, runErr)
+
+	s.store.Sinks.EmitAll(c.SinkNames, checkId, cr, time.Since(start), runErr)
+	cr.Delete()
+}
+
+func (s *Scheduler) record(checkId string, start time.Time, err error) {
+	s.mux.Lock()
+	h, ok := s.history[checkId]
+	if !ok {
+		h = &checkHistory{}
+		s.history[checkId] = h
+	}
+	s.mux.Unlock()
+
+	res := ScheduledResult{RunAt: start, Latency: time.Since(start), Success: err == nil}
+	if err != nil {
+		res.ErrorMsg = err.Error()
+	}
+	h.record(res)
+}
+
+// History returns the recorded ring buffer for a check, oldest first
+func (s *Scheduler) History(checkId string) []ScheduledResult {
+	s.mux.Lock()
+	h, ok := s.history[checkId]
+	s.mux.Unlock()
+	if !ok {
+		return nil
+	}
+	return h.snapshot()
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// GetHttpCheckHistory serves the ring buffer of past scheduled results for a check
+func GetHttpCheckHistory(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	id := ps.ByName("id")
+	c := server.httpCheckStore.Get(id)
+	if c == nil || c.Enabled == false {
+		jr.Error("Check not found")
+		fmt.Fprint(w, jr.ToString(debug))
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	authorized := len(token) > 0 && token == c.SecureToken
+	if !authorized && len(r.URL.Query().Get("sig")) > 0 {
+		authorized = verifySignedRequest(c.SecureToken, r)
+	}
+	if !authorized {
+		jr.Error("Secure token invalid")
+		fmt.Fprint(w, jr.ToString(debug))
+		return
+	}
+
+	jr.Set("history", server.scheduler.History(id))
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(debug))
+}
+
+// PatchHttpCheckPause pauses a check's schedule without disabling the check itself
+func PatchHttpCheckPause(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	setSchedulePaused(w, r, ps, true)
+}
+
+// PatchHttpCheckResume resumes a previously paused check's schedule
+func PatchHttpCheckResume(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	setSchedulePaused(w, r, ps, false)
+}
+
+func setSchedulePaused(w http.ResponseWriter, r *http.Request, ps httprouter.Params, paused bool) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(debug))
+		return
+	}
+	user := getUser(r)
+	if !user.HasRole("admin") {
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(debug))
+		return
+	}
+
+	id := ps.ByName("id")
+	c := server.httpCheckStore.Get(id)
+	if c == nil || c.Schedule == nil {
+		jr.Error("Check not found or not scheduled")
+		fmt.Fprint(w, jr.ToString(debug))
+		return
+	}
+
+	// Propose through the replicated store, like every other check mutation
+	if err := server.replicatedStore.SetSchedulePaused(id, paused, r); err != nil {
+		jr.Error(fmt.Sprintf("Failed to replicate schedule state: %s", err))
+		fmt.Fprint(w, jr.ToString(debug))
+		return
+	}
+
+	log.Println(fmt.Sprintf("INFO: Schedule for check %s paused=%t", id, paused))
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(debug))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func postForm(values url.Values) *http.Request {
+	return &http.Request{PostForm: values}
+}
+
+func TestParseScheduleFormReturnsNilWithoutCron(t *testing.T) {
+	sched, err := parseScheduleForm(postForm(url.Values{}))
+	if err != nil || sched != nil {
+		t.Fatalf("expected (nil, nil) without a cron field, got (%v, %v)", sched, err)
+	}
+}
+
+func TestParseScheduleFormRejectsInvalidCron(t *testing.T) {
+	_, err := parseScheduleForm(postForm(url.Values{"cron": {"not a cron"}}))
+	if err == nil {
+		t.Fatal("expected an error for an invalid cron expression")
+	}
+}
+
+func TestParseScheduleFormParsesJitterAndConcurrency(t *testing.T) {
+	sched, err := parseScheduleForm(postForm(url.Values{
+		"cron":               {"* * * * *"},
+		"jitter_max_seconds": {"5"},
+		"max_concurrency":    {"3"},
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if sched.JitterMax != 5*time.Second {
+		t.Errorf("expected JitterMax 5s, got %s", sched.JitterMax)
+	}
+	if sched.MaxConcurrency != 3 {
+		t.Errorf("expected MaxConcurrency 3, got %d", sched.MaxConcurrency)
+	}
+}
+
+func TestRescheduleReplacesPreviousEntry(t *testing.T) {
+	store := newHttpCheckStore()
+	s := newScheduler(store)
+	c := &HttpCheckConfiguration{Id: "check-1", Enabled: true, Schedule: &Schedule{Cron: "* * * * *"}}
+
+	s.Reschedule(c)
+	first := s.entries["check-1"]
+
+	s.Reschedule(c)
+	second := s.entries["check-1"]
+
+	if len(s.entries) != 1 {
+		t.Fatalf("expected exactly one cron entry for check-1, got %d", len(s.entries))
+	}
+	if len(s.cron.Entries()) != 1 {
+		t.Fatalf("expected exactly one registered cron job, got %d", len(s.cron.Entries()))
+	}
+	if first == second {
+		t.Error("expected Reschedule to register a fresh cron entry rather than reuse the old one")
+	}
+}
+
+func TestRescheduleSkipsPausedOrDisabledChecks(t *testing.T) {
+	store := newHttpCheckStore()
+	s := newScheduler(store)
+
+	s.Reschedule(&HttpCheckConfiguration{Id: "paused", Enabled: true, Schedule: &Schedule{Cron: "* * * * *", Paused: true}})
+	s.Reschedule(&HttpCheckConfiguration{Id: "disabled", Enabled: false, Schedule: &Schedule{Cron: "* * * * *"}})
+	s.Reschedule(&HttpCheckConfiguration{Id: "unscheduled", Enabled: true})
+
+	if len(s.entries) != 0 {
+		t.Errorf("expected no cron entries for paused/disabled/unscheduled checks, got %d", len(s.entries))
+	}
+}
+
+func TestRunScheduledSkipsWhenMaxConcurrencyReached(t *testing.T) {
+	store := newHttpCheckStore()
+	c := &HttpCheckConfiguration{Id: "check-1", Enabled: true, Schedule: &Schedule{Cron: "* * * * *", MaxConcurrency: 1}}
+	store.Add(c)
+
+	s := newScheduler(store)
+	s.inFlight["check-1"] = 1
+
+	// The inFlight gate must return before runScheduled ever reaches server.consensus
+	s.runScheduled("check-1")
+
+	if s.inFlight["check-1"] != 1 {
+		t.Errorf("expected inFlight to stay at 1, got %d", s.inFlight["check-1"])
+	}
+}
+
+func TestHistoryRingBufferTrimsToFixedSize(t *testing.T) {
+	store := newHttpCheckStore()
+	s := newScheduler(store)
+
+	for i := 0; i < scheduleHistorySize+10; i++ {
+		s.record("check-1", time.Now(), nil)
+	}
+
+	hist := s.History("check-1")
+	if len(hist) != scheduleHistorySize {
+		t.Fatalf("expected history capped at %d entries, got %d", scheduleHistorySize, len(hist))
+	}
+}
+
+func TestHistoryReturnsNilForUnknownCheck(t *testing.T) {
+	s := newScheduler(newHttpCheckStore())
+	if hist := s.History("never-seen"); hist != nil {
+		t.Errorf("expected nil history for an unknown check, got %v", hist)
+	}
+}
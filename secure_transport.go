@@ -0,0 +1,336 @@
+package main
+
+// mTLS transport between nodes, replacing the plain http:// discovery/consensus/execution calls,
+// plus HMAC request signing for the external http-check endpoint
+// @author Robin Verlangen
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const caCertFile = "ca.crt"
+const caKeyFile = "ca.key"
+const nodeCertFile = "node.crt"
+const nodeKeyFile = "node.key"
+const caValidity = 10 * 365 * 24 * time.Hour
+const certValidity = 180 * 24 * time.Hour
+const signatureReplayWindow = 5 * time.Minute
+
+// SecureTransport holds the per-cluster CA and this node's issued certificate, and produces the
+// shared *tls.Config used for mutual TLS between nodes
+type SecureTransport struct {
+	CertDir  string
+	caCert   *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+	nodeCert tls.Certificate
+}
+
+// newSecureTransport loads (or, on first boot, bootstraps) the cluster CA and this node's
+// certificate. Only the very first node in a cluster should ever generate a CA; every other node
+// joins by copying that node's ca.crt/ca.key into CertDir before starting, at which point this
+// issues a node cert signed by the shared CA instead of minting a CA of its own
+func newSecureTransport(certDir string, hostname string) (*SecureTransport, error) {
+	hostname = resolveHostname(hostname)
+	t := &SecureTransport{CertDir: certDir}
+	if !fileExists(filepath.Join(certDir, caCertFile)) {
+		if err := t.generateCA(); err != nil {
+			return nil, err
+		}
+	}
+	if !fileExists(filepath.Join(certDir, nodeCertFile)) {
+		if err := t.issueNodeCert(hostname); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// resolveHostname falls back to the OS hostname when none was explicitly configured
+func resolveHostname(hostname string) string {
+	if len(hostname) > 0 {
+		return hostname
+	}
+	if h, err := os.Hostname(); err == nil {
+		return h
+	}
+	return "localhost"
+}
+
+func fileExists(path string) bool {
+	_, err := ioutil.ReadFile(path)
+	return err == nil
+}
+
+// generateCA creates a new self-signed cluster CA and persists it to CertDir
+func (t *SecureTransport) generateCA() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "dispenso cluster CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	if err := writePem(filepath.Join(t.CertDir, caCertFile), "CERTIFICATE", der); err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePem(filepath.Join(t.CertDir, caKeyFile), "EC PRIVATE KEY", keyDer)
+}
+
+// issueNodeCert issues and persists a certificate for hostname, signed by the cluster CA
+func (t *SecureTransport) issueNodeCert(hostname string) error {
+	caCert, caKey, err := readCA(t.CertDir)
+	if err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	if err := writePem(filepath.Join(t.CertDir, nodeCertFile), "CERTIFICATE", der); err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePem(filepath.Join(t.CertDir, nodeKeyFile), "EC PRIVATE KEY", keyDer)
+}
+
+func (t *SecureTransport) load() error {
+	caCert, caKey, err := readCA(t.CertDir)
+	if err != nil {
+		return err
+	}
+	t.caCert = caCert
+	t.caKey = caKey
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(t.CertDir, nodeCertFile), filepath.Join(t.CertDir, nodeKeyFile))
+	if err != nil {
+		return err
+	}
+	t.nodeCert = cert
+	return nil
+}
+
+func readCA(certDir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPem, err := ioutil.ReadFile(filepath.Join(certDir, caCertFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPem, err := ioutil.ReadFile(filepath.Join(certDir, caKeyFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certPem)
+	keyBlock, _ := pem.Decode(keyPem)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("Invalid CA PEM data")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func writePem(path string, blockType string, der []byte) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+}
+
+// TLSConfig returns the shared mutual-TLS config used for all inter-node calls
+func (t *SecureTransport) TLSConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(t.caCert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{t.nodeCert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// isClusterPeer reports whether r arrived over the mTLS listener with a peer certificate verified
+// against our own CA, as opposed to the plain auth-only listener any admin user reaches
+func isClusterPeer(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// Client returns an *http.Client configured for mutual TLS against other cluster nodes
+func (t *SecureTransport) Client() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: t.TLSConfig()},
+	}
+}
+
+// ListenAndServeTLS terminates mutual TLS on addr using the cluster's shared TLS config
+func (t *SecureTransport) ListenAndServeTLS(addr string, handler http.Handler) error {
+	ln, err := tls.Listen("tcp", addr, t.TLSConfig())
+	if err != nil {
+		return err
+	}
+	return http.Serve(ln, handler)
+}
+
+// signRequest computes the HMAC-SHA256 signature for an external http-check request, over
+// "timestamp:nonce:path", keyed with the check's SecureToken
+func signRequest(secureToken string, timestamp int64, nonce string, path string) string {
+	mac := hmac.New(sha256.New, []byte(secureToken))
+	mac.Write([]byte(fmt.Sprintf("%d:%s:%s", timestamp, nonce, path)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signatureNonces tracks nonces seen within the last signatureReplayWindow, rejecting replays
+var signatureNonces = newNonceCache()
+
+// nonceCache records each recently-seen nonce with the time it was first seen; entries older than
+// signatureReplayWindow are pruned by checkAndRemember, and there is no cap on the number of entries
+type nonceCache struct {
+	seen map[string]time.Time
+	mux  sync.Mutex
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{seen: make(map[string]time.Time)}
+}
+
+// checkAndRemember returns true the first time nonce is seen within signatureReplayWindow, and
+// false on every repeat; expired entries are pruned on every call
+func (c *nonceCache) checkAndRemember(nonce string, now time.Time) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for n, seenAt := range c.seen {
+		if now.Sub(seenAt) > signatureReplayWindow {
+			delete(c.seen, n)
+		}
+	}
+	if _, replayed := c.seen[nonce]; replayed {
+		return false
+	}
+	c.seen[nonce] = now
+	return true
+}
+
+// verifySignedRequest checks the HMAC signature on an external http-check request and rejects
+// requests outside the replay window or with an already-seen nonce
+func verifySignedRequest(secureToken string, r *http.Request) bool {
+	tsStr := r.URL.Query().Get("ts")
+	nonce := r.URL.Query().Get("nonce")
+	sig := r.URL.Query().Get("sig")
+	if len(tsStr) == 0 || len(nonce) == 0 || len(sig) == 0 {
+		return false
+	}
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(ts, 0))
+	if age < 0 {
+		age = -age
+	}
+	if age > signatureReplayWindow {
+		return false
+	}
+
+	path := r.URL.Path
+	if idx := strings.Index(r.URL.String(), "?"); idx >= 0 {
+		path = r.URL.String()[:idx]
+	}
+	expected := signRequest(secureToken, ts, nonce, path)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(sig)) != 1 {
+		return false
+	}
+	return signatureNonces.checkAndRemember(nonce, time.Now())
+}
+
+// runCaCommand implements "dispenso ca [certDir] [hostname]", rotating the cluster CA and
+// re-issuing this node's certificate
+func runCaCommand(args []string) error {
+	certDir := "/etc/indispenso/certs"
+	if len(args) > 0 {
+		certDir = args[0]
+	}
+	hostname := ""
+	if len(args) > 1 {
+		hostname = args[1]
+	}
+	hostname = resolveHostname(hostname)
+
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("Rotating cluster CA in %s\n", certDir))
+
+	t := &SecureTransport{CertDir: certDir}
+	if err := t.generateCA(); err != nil {
+		return err
+	}
+	if err := t.issueNodeCert(hostname); err != nil {
+		return err
+	}
+	buf.WriteString(fmt.Sprintf("CA rotated, certificate re-issued for %s\n", hostname))
+	fmt.Print(buf.String())
+	return nil
+}
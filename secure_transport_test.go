@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func signedRequest(secureToken string, ts int64, nonce string) *http.Request {
+	path := "/check/abc"
+	sig := signRequest(secureToken, ts, nonce, path)
+	u, _ := url.Parse(fmt.Sprintf("%s?ts=%d&nonce=%s&sig=%s", path, ts, nonce, sig))
+	return &http.Request{URL: u}
+}
+
+func TestVerifySignedRequestAcceptsValidSignature(t *testing.T) {
+	signatureNonces = newNonceCache()
+	r := signedRequest("secret", time.Now().Unix(), "nonce-1")
+	if !verifySignedRequest("secret", r) {
+		t.Error("expected a freshly signed request to verify")
+	}
+}
+
+func TestVerifySignedRequestRejectsWrongToken(t *testing.T) {
+	signatureNonces = newNonceCache()
+	r := signedRequest("secret", time.Now().Unix(), "nonce-2")
+	if verifySignedRequest("wrong-secret", r) {
+		t.Error("expected verification to fail against the wrong token")
+	}
+}
+
+func TestVerifySignedRequestRejectsExpiredTimestamp(t *testing.T) {
+	signatureNonces = newNonceCache()
+	r := signedRequest("secret", time.Now().Add(-2*signatureReplayWindow).Unix(), "nonce-3")
+	if verifySignedRequest("secret", r) {
+		t.Error("expected verification to fail for a timestamp outside the replay window")
+	}
+}
+
+func TestVerifySignedRequestRejectsReplayedNonce(t *testing.T) {
+	signatureNonces = newNonceCache()
+	r := signedRequest("secret", time.Now().Unix(), "nonce-4")
+	if !verifySignedRequest("secret", r) {
+		t.Fatal("expected the first use of the signed request to verify")
+	}
+	if verifySignedRequest("secret", r) {
+		t.Error("expected a replayed nonce to be rejected on the second use")
+	}
+}
+
+func TestNonceCachePrunesExpiredEntries(t *testing.T) {
+	c := newNonceCache()
+	old := time.Now().Add(-2 * signatureReplayWindow)
+	if !c.checkAndRemember("stale", old) {
+		t.Fatal("expected the first sighting of a nonce to be remembered")
+	}
+
+	now := time.Now()
+	if !c.checkAndRemember("fresh", now) {
+		t.Fatal("expected a new nonce to be remembered")
+	}
+	if _, stillPresent := c.seen["stale"]; stillPresent {
+		t.Error("expected the expired nonce to have been pruned")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+// Streaming visibility into a running check, over WebSocket (falling back to SSE), so callers no
+// longer have to block blind on a single terminal OK/Error
+// @author Robin Verlangen
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CheckEventType is the kind of progress frame pushed onto a check's event bus
+type CheckEventType string
+
+const (
+	EventQueued   CheckEventType = "queued"
+	EventApproved CheckEventType = "approved"
+	EventResult   CheckEventType = "result"
+
+	// Defined for per-client execution output; nothing publishes these event types
+	EventStdout     CheckEventType = "stdout"
+	EventStderr     CheckEventType = "stderr"
+	EventClientDone CheckEventType = "client_done"
+)
+
+// CheckStreamEvent is one frame published on a check's event bus, serialized as-is to subscribers
+type CheckStreamEvent struct {
+	Type     CheckEventType `json:"type"`
+	ClientId string         `json:"client_id,omitempty"`
+	Data     string         `json:"data,omitempty"`
+	Success  bool           `json:"success,omitempty"`
+	At       time.Time      `json:"at"`
+}
+
+// CheckEventBus is a typed event bus so multiple subscribers can observe a check's progress
+type CheckEventBus struct {
+	subscribers map[int]chan CheckStreamEvent
+	nextId      int
+	closed      bool
+	mux         sync.Mutex
+}
+
+func newCheckEventBus() *CheckEventBus {
+	return &CheckEventBus{subscribers: make(map[int]chan CheckStreamEvent)}
+}
+
+// Subscribe registers a new listener; the returned cancel func must be called once the caller is
+// done. A bus that already closed hands back an already-closed channel.
+func (b *CheckEventBus) Subscribe() (<-chan CheckStreamEvent, func()) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	ch := make(chan CheckStreamEvent, 32)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	id := b.nextId
+	b.nextId++
+	b.subscribers[id] = ch
+	return ch, func() {
+		b.mux.Lock()
+		defer b.mux.Unlock()
+		if sub, ok := b.subscribers[id]; ok {
+			delete(b.subscribers, id)
+			close(sub)
+		}
+	}
+}
+
+// Publish fans an event out to every current subscriber, dropping it for a subscriber that isn't
+// keeping up rather than blocking the check itself
+func (b *CheckEventBus) Publish(evt CheckStreamEvent) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.closed {
+		return
+	}
+	evt.At = time.Now()
+	for id, ch := range b.subscribers {
+		select {
+		case ch <- evt:
+		default:
+			log.Println(fmt.Sprintf("WARN: Check stream subscriber %d is slow, dropping event %s", id, evt.Type))
+		}
+	}
+	if evt.Type == EventResult {
+		b.closeLocked()
+	}
+}
+
+func (b *CheckEventBus) closeLocked() {
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for id, ch := range b.subscribers {
+		delete(b.subscribers, id)
+		close(ch)
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// StreamHttpCheck upgrades to WebSocket (or falls back to SSE) and pushes queued, approved and
+// result frames as the check's ConsensusRequest progresses; no stdout/stderr/client_done frames are sent
+func StreamHttpCheck(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	c := server.httpCheckStore.Get(id)
+	if c == nil || !c.Enabled {
+		http.Error(w, "Check not found", http.StatusNotFound)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	authorized := len(token) > 0 && token == c.SecureToken
+	if !authorized && len(r.URL.Query().Get("sig")) > 0 {
+		authorized = verifySignedRequest(c.SecureToken, r)
+	}
+	if !authorized {
+		http.Error(w, "Secure token invalid", http.StatusForbidden)
+		return
+	}
+
+	bus := newCheckEventBus()
+
+	// Subscribe before anything is published or triggered, so the queued/approved frames (and a
+	// check that finishes before we get around to reading the bus) are never missed
+	events, cancel := bus.Subscribe()
+	defer cancel()
+
+	bus.Publish(CheckStreamEvent{Type: EventQueued})
+
+	cr := server.consensus.AddRequest(c.TemplateId, c.ClientIds, server.httpCheckStore.SystemUser, "")
+	if cr == nil {
+		bus.Publish(CheckStreamEvent{Type: EventResult, Success: false, Data: "Unable to start check"})
+		streamEvents(w, r, events)
+		return
+	}
+	bus.Publish(CheckStreamEvent{Type: EventApproved})
+
+	cr.Callbacks = append(cr.Callbacks, func(cr *ConsensusRequest) {
+		bus.Publish(CheckStreamEvent{Type: EventResult, Success: true})
+	})
+	cr.check()
+
+	go func() {
+		<-time.After(time.Duration(c.Timeout) * time.Second)
+		bus.Publish(CheckStreamEvent{Type: EventResult, Success: false, Data: "Timeout"})
+	}()
+
+	streamEvents(w, r, events)
+
+	// Cleanup promptly once the stream has delivered its terminal frame (or the client went away),
+	// rather than leaving the ConsensusRequest to linger until the background timeout above fires
+	cr.Delete()
+}
+
+// streamEvents drains an already-subscribed channel to a WebSocket connection, or to an SSE stream
+// when the client didn't ask to upgrade; the caller owns the subscription's cancel func
+func streamEvents(w http.ResponseWriter, r *http.Request, ch <-chan CheckStreamEvent) {
+	if websocket.IsWebSocketUpgrade(r) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Println(fmt.Sprintf("ERR: Failed to upgrade check stream: %s", err))
+			return
+		}
+		defer conn.Close()
+		for evt := range ch {
+			if err := conn.WriteJSON(evt); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	for {
+		select {
+		case evt, open := <-ch:
+			if !open {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evt.Type, evt.Data)
+			if ok {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
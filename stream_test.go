@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckEventBusDeliversToSubscriber(t *testing.T) {
+	bus := newCheckEventBus()
+	ch, cancel := bus.Subscribe()
+	defer cancel()
+
+	bus.Publish(CheckStreamEvent{Type: EventQueued})
+
+	select {
+	case evt := <-ch:
+		if evt.Type != EventQueued {
+			t.Errorf("expected %s, got %s", EventQueued, evt.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for published event")
+	}
+}
+
+func TestCheckEventBusClosesSubscribersOnResult(t *testing.T) {
+	bus := newCheckEventBus()
+	ch, cancel := bus.Subscribe()
+	defer cancel()
+
+	bus.Publish(CheckStreamEvent{Type: EventResult, Success: true})
+
+	select {
+	case evt, open := <-ch:
+		if !open {
+			t.Fatal("expected the buffered result event first, got a closed channel")
+		}
+		if evt.Type != EventResult {
+			t.Errorf("expected %s, got %s", EventResult, evt.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for result event")
+	}
+
+	select {
+	case _, open := <-ch:
+		if open {
+			t.Error("expected the channel to be closed after the result event was drained")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for channel to report closed")
+	}
+}
+
+func TestCheckEventBusSubscribeAfterCloseGetsClosedChannel(t *testing.T) {
+	bus := newCheckEventBus()
+	bus.Publish(CheckStreamEvent{Type: EventResult})
+
+	// A subscriber attaching after the bus already closed (e.g. a terminal result beat the
+	// subscriber to the bus) must get a channel that is already closed, not one that blocks forever
+	ch, cancel := bus.Subscribe()
+	defer cancel()
+
+	select {
+	case _, open := <-ch:
+		if open {
+			t.Error("expected a post-close subscription to receive an already-closed channel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for channel to report closed")
+	}
+}
+
+func TestCheckEventBusSupportsMultipleSubscribers(t *testing.T) {
+	bus := newCheckEventBus()
+	ch1, cancel1 := bus.Subscribe()
+	defer cancel1()
+	ch2, cancel2 := bus.Subscribe()
+	defer cancel2()
+
+	bus.Publish(CheckStreamEvent{Type: EventApproved})
+
+	for i, ch := range []<-chan CheckStreamEvent{ch1, ch2} {
+		select {
+		case evt := <-ch:
+			if evt.Type != EventApproved {
+				t.Errorf("subscriber %d: expected %s, got %s", i, EventApproved, evt.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("subscriber %d: timed out waiting for published event", i)
+		}
+	}
+}